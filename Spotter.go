@@ -3,22 +3,38 @@ package main
 import (
 	"bufio"
 	"bytes"
+	cryptorand "crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"gopkg.in/yaml.v3"
 )
 
 type headers []string
@@ -37,16 +53,161 @@ func (this headers) String() string {
 	return buffer.String()
 }
 
+// Result is a concurrent-safe running tally, updated via atomic ops by the
+// aggregator goroutine as Outputs arrive (inFlight by the bench() workers
+// around each request) and read by the progress ticker
+// and /metrics handler while the run is still in flight.
 type Result struct {
 	requests      int64
 	success       int64
 	networkFailed int64
 	badFailed     int64
+	bytesIn       int64
+	bytesOut      int64
+	inFlight      int64
+}
+
+const latencyReservoirSize = 8192
+
+// resultBufferSize bounds the Output channel so multi-million-request runs
+// don't pre-allocate a buffer sized to the whole run up front.
+const resultBufferSize = 4096
+
+// latencyReservoir holds the most recent latency samples (ms) in a ring
+// buffer, bounding memory on high-RPS runs while still giving the live
+// progress ticker a representative percentile estimate.
+type latencyReservoir struct {
+	mu      sync.Mutex
+	samples [latencyReservoirSize]float64
+	count   int64
+}
+
+func (r *latencyReservoir) add(ms float64) {
+	r.mu.Lock()
+	r.samples[r.count%latencyReservoirSize] = ms
+	r.count++
+	r.mu.Unlock()
+}
+
+func (r *latencyReservoir) snapshot() []float64 {
+	r.mu.Lock()
+	n := r.count
+	if n > latencyReservoirSize {
+		n = latencyReservoirSize
+	}
+	cp := make([]float64, n)
+	copy(cp, r.samples[:n])
+	r.mu.Unlock()
+	return cp
+}
+
+func (r *latencyReservoir) percentiles() (p50, p90, p99, p999, max float64) {
+	samples := r.snapshot()
+	sort.Float64s(samples)
+	return percentile(samples, 50), percentile(samples, 90), percentile(samples, 99), percentile(samples, 99.9), percentile(samples, 100)
+}
+
+// latencyHistogram accumulates every sample for the whole run into fixed,
+// monotonically-increasing buckets (HDR-histogram style) instead of
+// retaining only the most recent latencyReservoirSize samples. The final
+// summary (and, from chunk0-4, the /metrics scrape) both read from this
+// rather than the reservoir, so a run with more than latencyReservoirSize
+// requests still gets whole-run percentiles and a count that only ever
+// goes up.
+type latencyHistogram struct {
+	buckets []float64 // upper bounds (ms), ascending; samples above the last are only in count
+	counts  []int64   // cumulative count of samples <= buckets[i], atomic
+	count   int64     // total samples seen, atomic
+	sumBits uint64    // sum of all samples (ms), atomic, as math.Float64bits
+	maxBits uint64    // max sample (ms) seen, atomic, as math.Float64bits
+}
+
+func newLatencyHistogram(buckets []float64) *latencyHistogram {
+	return &latencyHistogram{
+		buckets: buckets,
+		counts:  make([]int64, len(buckets)),
+	}
+}
+
+func (h *latencyHistogram) add(ms float64) {
+	for i, bound := range h.buckets {
+		if ms <= bound {
+			atomic.AddInt64(&h.counts[i], 1)
+		}
+	}
+	atomic.AddInt64(&h.count, 1)
+	atomicAddFloat64(&h.sumBits, ms)
+	atomicMaxFloat64(&h.maxBits, ms)
+}
+
+// snapshot returns the current cumulative bucket counts, sum, and count for
+// rendering a Prometheus histogram.
+func (h *latencyHistogram) snapshot() (counts []int64, sum float64, count int64) {
+	counts = make([]int64, len(h.buckets))
+	for i := range h.buckets {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	sum = math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+	count = atomic.LoadInt64(&h.count)
+	return
+}
+
+func (h *latencyHistogram) percentiles() (p50, p90, p99, p999, max float64) {
+	total := atomic.LoadInt64(&h.count)
+	if total == 0 {
+		return 0, 0, 0, 0, 0
+	}
+	max = math.Float64frombits(atomic.LoadUint64(&h.maxBits))
+	return h.quantile(total, 0.50), h.quantile(total, 0.90), h.quantile(total, 0.99), h.quantile(total, 0.999), max
+}
+
+// quantile returns the smallest bucket bound whose cumulative count covers
+// at least the q-th fraction of total samples.
+func (h *latencyHistogram) quantile(total int64, q float64) float64 {
+	target := int64(math.Ceil(q * float64(total)))
+	for i, bound := range h.buckets {
+		if atomic.LoadInt64(&h.counts[i]) >= target {
+			return bound
+		}
+	}
+	return math.Float64frombits(atomic.LoadUint64(&h.maxBits))
+}
+
+// atomicAddFloat64 and atomicMaxFloat64 give us the equivalent of
+// atomic.AddInt64/atomic.CompareAndSwapInt64 for float64, which sync/atomic
+// doesn't provide directly: bits stores the float64 reinterpreted as a
+// uint64, and a CAS loop handles the read-modify-write.
+func atomicAddFloat64(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		newVal := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, newVal) {
+			return
+		}
+	}
+}
+
+func atomicMaxFloat64(bits *uint64, value float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if value <= math.Float64frombits(old) {
+			return
+		}
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(value)) {
+			return
+		}
+	}
 }
 
 type Output struct {
-	category string
-	respBody string
+	category      string
+	respBody      string
+	intendedStart time.Time // when the open-loop scheduler meant to fire this request
+	sent          time.Time // when client.Do was actually called
+	received      time.Time // when the response (or error) came back
+	bytesIn       int64
+	bytesOut      int64
+	reused        bool // connection was reused rather than freshly dialed
 }
 
 type ResultFile struct {
@@ -55,11 +216,103 @@ type ResultFile struct {
 	Succ []string
 }
 
+// ExtractRule pulls a value out of a step's response body into the
+// per-worker variable store, for use as {{.name}} in a later step.
+type ExtractRule struct {
+	Name     string `yaml:"name" json:"name"`
+	Regex    string `yaml:"regex" json:"regex"`
+	JSONPath string `yaml:"jsonpath" json:"jsonpath"`
+}
+
+// Step is one request in a Scenario. URL, Headers, and Body are all
+// text/template sources rendered against the worker's variable store
+// before the request is built.
+type Step struct {
+	Method  string            `yaml:"method" json:"method"`
+	URL     string            `yaml:"url" json:"url"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	Body    string            `yaml:"body" json:"body"`
+	Weight  int               `yaml:"weight" json:"weight"`
+	Extract []ExtractRule     `yaml:"extract" json:"extract"`
+}
+
+// Scenario replaces the single-URL model with a list of steps. If any step
+// carries a Weight > 0, each iteration picks one step via weighted random
+// selection (a URL list); otherwise every step runs in order each
+// iteration (a sequential flow).
+type Scenario struct {
+	Steps []Step `yaml:"steps" json:"steps"`
+}
+
+func (s *Scenario) usesWeights() bool {
+	for _, step := range s.Steps {
+		if step.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pickWeighted chooses a single step at random, weighted by Step.Weight
+// (steps with no weight count as 1).
+func (s *Scenario) pickWeighted() *Step {
+	total := 0
+	for _, step := range s.Steps {
+		total += stepWeight(step)
+	}
+
+	roll := rand.Intn(total)
+	for i := range s.Steps {
+		w := stepWeight(s.Steps[i])
+		if roll < w {
+			return &s.Steps[i]
+		}
+		roll -= w
+	}
+
+	return &s.Steps[len(s.Steps)-1]
+}
+
+func stepWeight(step Step) int {
+	if step.Weight <= 0 {
+		return 1
+	}
+	return step.Weight
+}
+
+func loadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenario Scenario
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &scenario)
+	} else {
+		err = yaml.Unmarshal(data, &scenario)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing scenario %s: %w", path, err)
+	}
+
+	if len(scenario.Steps) == 0 {
+		return nil, fmt.Errorf("scenario %s declares no steps", path)
+	}
+
+	return &scenario, nil
+}
+
 type Configuration struct {
 	request      *http.Request
-	client       *http.Client
+	scenario     *Scenario
 	requests     int64
 	resultBuffer chan *Output
+	result       *Result
+	latencies    *latencyReservoir // recency-biased, for the live ticker only
+	histogram    *latencyHistogram // whole-run, for the summary and /metrics
+	startedAt    time.Time
+	auth         AuthProvider
 }
 
 var (
@@ -74,10 +327,63 @@ var (
 	redirects       int
 	devLogger       bool
 	obnoxiousHeader bool
+	requestProto    string
+	maxStreams      int
+	connsPerClient  int
+	requestRate     float64
+	ratePerClient   bool
+	poissonArrivals bool
+	scenarioFile    string
+	metricsAddr     string
+	captureMode     string
+	outputFormat    string
+	authFlag        string
+	clientCertFile  string
+	clientKeyFile   string
+	caCertFile      string
+	insecureSkip    bool
 	version         = "dev" // replace during make with -ldflags
 	build           = "dev" // replace during make with -ldflags
 )
 
+// supportedProtocols lists the -proto values bench() knows how to drive.
+var supportedProtocols = map[string]bool{
+	"h1":  true,
+	"h2":  true,
+	"h2c": true,
+	"h3":  true,
+}
+
+// -capture modes: how much of each response crunchRequest keeps around.
+const (
+	CaptureNone        = "none"
+	CaptureStatus      = "status"
+	CaptureHeaders     = "headers"
+	CaptureBody        = "body"
+	CaptureBodyOnError = "body-on-error"
+)
+
+var supportedCaptureModes = map[string]bool{
+	CaptureNone:        true,
+	CaptureStatus:      true,
+	CaptureHeaders:     true,
+	CaptureBody:        true,
+	CaptureBodyOnError: true,
+}
+
+// -output-format values, each backed by a Writer implementation.
+const (
+	OutputFormatJSON   = "json"
+	OutputFormatNDJSON = "ndjson"
+	OutputFormatCSV    = "csv"
+)
+
+var supportedOutputFormats = map[string]bool{
+	OutputFormatJSON:   true,
+	OutputFormatNDJSON: true,
+	OutputFormatCSV:    true,
+}
+
 const (
 	GunShow               = "\U0001f4aa"
 	DefaultRequestTimeout = 30 * time.Second
@@ -95,13 +401,28 @@ func init() {
 	flag.IntVar(&clients, "clients", 1, "Number of workers")
 	flag.StringVar(&requestMethod, "type", "GET", "HTTP Request Type")
 	flag.StringVar(&requestBody, "data", "", "The Request Data")
-	flag.StringVar(&outputFile, "output", "", "The Output File Location")
+	flag.StringVar(&outputFile, "output", "", "The Output File Location, or - for stdout")
 	flag.Var(&requestHeaders, "header", "The Request Headers")
 	flag.BoolVar(&displayVersion, "version", false, "Version")
 	flag.DurationVar(&requestTimeout, "reqTimeout", DefaultRequestTimeout, "Timeout Per Request")
 	flag.IntVar(&redirects, "redirects", DefaultRedirects, "Number of redirects to allow. -1 means no follow.")
 	flag.BoolVar(&devLogger, "dev", false, "Logging internals for dev use")
 	flag.BoolVar(&obnoxiousHeader, "oh", false, "Displays a reallllly obnoxious header.(Please don't use this)")
+	flag.StringVar(&requestProto, "proto", "h1", "Transport protocol to benchmark: h1, h2, h2c, h3")
+	flag.IntVar(&maxStreams, "max-streams", 100, "Max concurrent streams per connection (h2/h3 only)")
+	flag.IntVar(&connsPerClient, "conns-per-client", 1, "Independent connections each client keeps open")
+	flag.Float64Var(&requestRate, "rate", 0, "Requests/sec to drive in an open loop. 0 means closed-loop (as fast as possible)")
+	flag.BoolVar(&ratePerClient, "rate-per-client", false, "Treat -rate as per-client instead of an aggregate across all clients")
+	flag.BoolVar(&poissonArrivals, "poisson", false, "Space -rate arrivals with a Poisson process instead of a fixed interval")
+	flag.StringVar(&scenarioFile, "scenario", "", "YAML or JSON scenario file describing a weighted URL list or a sequential flow")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address (e.g. :9090) to serve /metrics and /livez on while the run is in progress")
+	flag.StringVar(&captureMode, "capture", CaptureBody, "How much of each response to keep: none, status, headers, body, body-on-error")
+	flag.StringVar(&outputFormat, "output-format", OutputFormatJSON, "Format for -output: json, ndjson, csv")
+	flag.StringVar(&authFlag, "auth", "", "Auth for the target: basic:user:pass, bearer:@token.txt, or oauth2:cfg.json")
+	flag.StringVar(&clientCertFile, "client-cert", "", "Client certificate for mTLS")
+	flag.StringVar(&clientKeyFile, "client-key", "", "Client key for mTLS")
+	flag.StringVar(&caCertFile, "ca-cert", "", "CA certificate to verify the server against")
+	flag.BoolVar(&insecureSkip, "insecure", false, "Skip TLS certificate verification (opt-in; off by default)")
 	flag.Usage = usage
 }
 
@@ -117,28 +438,79 @@ func main() {
 		fmt.Println(ObnoxiousHeader)
 	}
 
-	args := flag.Args()
-	if len(args) != 1 {
-		flag.Usage()
+	var httpRequest *http.Request
+	var scenario *Scenario
+
+	if scenarioFile != "" {
+		var err error
+		scenario, err = loadScenario(scenarioFile)
+		if err != nil {
+			fmt.Printf("[SPOTTER]: Could not load scenario %q: %v\n", scenarioFile, err)
+			os.Exit(1)
+		}
+	} else {
+		args := flag.Args()
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		urlDirty := args[0]
+		if !strings.Contains(urlDirty, "://") && !strings.HasPrefix(urlDirty, "//") {
+			logMeUpFam("Adding // to input url")
+			urlDirty = "//" + urlDirty
+		}
+
+		urlClean, err := url.Parse(urlDirty)
+		if err != nil {
+			fmt.Printf("[SPOTTER]: Could not parse URL %q: %v", urlDirty, err)
+			os.Exit(1)
+		}
+
+		httpRequest = createHttpRequest(requestMethod, requestBody, requestHeaders, urlClean)
+	}
+
+	if !supportedProtocols[requestProto] {
+		fmt.Printf("[SPOTTER]: Unknown -proto %q, must be one of h1, h2, h2c, h3\n", requestProto)
 		os.Exit(1)
 	}
 
-	urlDirty := args[0]
-	if !strings.Contains(urlDirty, "://") && !strings.HasPrefix(urlDirty, "//") {
-		logMeUpFam("Adding // to input url")
-		urlDirty = "//" + urlDirty
+	if !supportedCaptureModes[captureMode] {
+		fmt.Printf("[SPOTTER]: Unknown -capture %q, must be one of none, status, headers, body, body-on-error\n", captureMode)
+		os.Exit(1)
 	}
 
-	urlClean, err := url.Parse(urlDirty)
-	if err != nil {
-		fmt.Printf("[SPOTTER]: Could not parse URL %q: %v", urlDirty, err)
+	if !supportedOutputFormats[outputFormat] {
+		fmt.Printf("[SPOTTER]: Unknown -output-format %q, must be one of json, ndjson, csv\n", outputFormat)
 		os.Exit(1)
 	}
 
-	httpRequest := createHttpRequest(requestMethod, requestBody, requestHeaders, urlClean)
+	if connsPerClient < 1 {
+		connsPerClient = 1
+	}
+
+	var auth AuthProvider
+	if authFlag != "" {
+		var err error
+		auth, err = parseAuthFlag(authFlag)
+		if err != nil {
+			fmt.Printf("[SPOTTER]: Invalid -auth %q: %v\n", authFlag, err)
+			os.Exit(1)
+		}
+	}
 
 	fmt.Printf("[SPOTTER]: Starting tests with %d clients and %d requests per client\n", clients, requests)
 
+	var writer Writer
+	if outputFile != "" {
+		w, err := newWriter(outputFormat, outputFile)
+		if err != nil {
+			fmt.Printf("[SPOTTER]: Could not open -output %q: %v\n", outputFile, err)
+			os.Exit(1)
+		}
+		writer = &syncWriter{w: w}
+	}
+
 	start := time.Now()
 	var barrier sync.WaitGroup
 	sigChannel := make(chan os.Signal, 2)
@@ -147,6 +519,11 @@ func main() {
 	go func() {
 		_ = <-sigChannel
 		fmt.Println("[SPOTTER]: Exiting on interrupt...")
+		if writer != nil {
+			if err := writer.Close(); err != nil {
+				fmt.Println("[SPOTTER]: Error closing output writer: ", err)
+			}
+		}
 		os.Exit(0)
 	}()
 
@@ -159,8 +536,10 @@ func main() {
 		IP: net.IPv4zero,
 	}
 
-	defaultTLSConfig := &tls.Config{
-		InsecureSkipVerify: true,
+	defaultTLSConfig, err := newTLSConfig()
+	if err != nil {
+		fmt.Printf("[SPOTTER]: TLS configuration error: %v\n", err)
+		os.Exit(1)
 	}
 
 	dialer := &net.Dialer{
@@ -169,90 +548,251 @@ func main() {
 		Timeout:   requestTimeout,
 	}
 
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial:  dialer.Dial,
-		ResponseHeaderTimeout: requestTimeout,
-		TLSClientConfig:       defaultTLSConfig,
-		TLSHandshakeTimeout:   10 * time.Second,
-		MaxIdleConnsPerHost:   10000, // this should be a variable :thinking_face:
+	stepsPerIteration := int64(1)
+	if scenario != nil && !scenario.usesWeights() {
+		stepsPerIteration = int64(len(scenario.Steps))
 	}
+	totalRequests := requests * int64(clients) * stepsPerIteration
 
-	httpClient := &http.Client{
-		Transport: transport,
-	}
-
-	httpClient.CheckRedirect = func(req *http.Request, reqList []*http.Request) error {
-		switch {
-		case redirects == -1:
-			return http.ErrUseLastResponse
-		case len(reqList) > redirects:
-			return fmt.Errorf("[SPOTTER]: Followed %d redirects. Stopping...", redirects)
-		default:
-			return nil
-		}
-	}
-
-	bufferedChan := make(chan *Output, requests*int64(clients))
+	// Bounded rather than sized to totalRequests: a multi-million-request
+	// run would otherwise pre-allocate an enormous channel buffer. The
+	// aggregator goroutine drains it concurrently, so workers only ever
+	// block briefly when it falls behind.
+	bufferedChan := make(chan *Output, resultBufferSize)
 
 	config := &Configuration{
 		httpRequest,
-		httpClient,
+		scenario,
 		requests,
 		bufferedChan,
+		&Result{},
+		&latencyReservoir{},
+		newLatencyHistogram(latencyBuckets),
+		start,
+		auth,
+	}
+
+	if metricsAddr != "" {
+		startMetricsServer(metricsAddr, config)
+	}
+
+	var schedule <-chan time.Time
+	if requestRate > 0 {
+		effectiveRate := requestRate
+		if ratePerClient {
+			effectiveRate = requestRate * float64(clients)
+		}
+		schedule = scheduleArrivals(effectiveRate, poissonArrivals, totalRequests)
 	}
 
+	drainDone := make(chan struct{})
+	go func() {
+		defer close(drainDone)
+		for output := range bufferedChan {
+			recordOutput(config, writer, output)
+		}
+	}()
+
+	progressDone := make(chan struct{})
+	go printProgress(config, progressDone)
+
 	barrier.Add(clients)
 	for i := 0; i < clients; i++ {
 		logMeUpFam(fmt.Sprintf("Starting client: %d", i))
-		go bench(config, &barrier, i)
+		pool := newClientPool(connsPerClient, requestProto, defaultTLSConfig, dialer)
+		go bench(config, pool, schedule, &barrier, i)
 	}
 
-	total := 0
-	netFailed := 0
-	badFailed := 0
-	succ := 0
-	file := &ResultFile{}
-
 	fmt.Println("[SPOTTER]: Drum roll please...")
 	logMeUpFam(fmt.Sprintf("Waiting for %d clients to finish...\n", clients))
 	barrier.Wait()
 	elapsed := float64(time.Since(start).Seconds())
 	close(bufferedChan)
+	<-drainDone
+	close(progressDone)
 
-	for output := range bufferedChan {
-		switch output.category {
-		case "net":
-			netFailed++
-			file.Net = append(file.Net, output.respBody)
-		case "bad":
-			badFailed++
-			file.Bad = append(file.Bad, output.respBody)
-		case "succ":
-			succ++
-			file.Succ = append(file.Succ, output.respBody)
+	if writer != nil {
+		if err := writer.Close(); err != nil {
+			fmt.Println("[SPOTTER]: Error closing output writer: ", err)
 		}
-		total++
 	}
 
-	if outputFile != "" {
-		stats, err := json.Marshal(file)
-		if err != nil {
-			fmt.Println("[SPOTTER]: Error Marshalling JSON: ", err)
-		}
-		err = writeOutputFile(outputFile, stats)
-		if err != nil {
-			fmt.Println("[SPOTTER]: Couldn't Write Output File: ", err)
-		}
-	}
+	total := atomic.LoadInt64(&config.result.requests)
+	p50, p90, p99, p999, max := config.histogram.percentiles()
 
 	fmt.Println("RESULTS:")
 	fmt.Printf("- Request Number: %d\n", total)
-	fmt.Printf("- Successful: %d\n", succ)
-	fmt.Printf("- Network Failed: %d\n", netFailed)
-	fmt.Printf("- Bad Failed: %d\n", badFailed)
+	fmt.Printf("- Successful: %d\n", atomic.LoadInt64(&config.result.success))
+	fmt.Printf("- Network Failed: %d\n", atomic.LoadInt64(&config.result.networkFailed))
+	fmt.Printf("- Bad Failed: %d\n", atomic.LoadInt64(&config.result.badFailed))
 	fmt.Printf("- Requests Per Second: %10f\n", float64(total)/elapsed)
 	fmt.Printf("- Program took: %10f second(s)\n", elapsed)
+
+	fmt.Println("LATENCY (ms, intendedStart -> received, queueing delay included):")
+	fmt.Printf("- p50:   %10f\n", p50)
+	fmt.Printf("- p90:   %10f\n", p90)
+	fmt.Printf("- p99:   %10f\n", p99)
+	fmt.Printf("- p99.9: %10f\n", p999)
+	fmt.Printf("- max:   %10f\n", max)
+}
+
+// recordOutput folds one Output into the concurrent-safe Result tally, the
+// latency reservoir and histogram, and hands it to the output Writer (if
+// any). It runs on the aggregator
+// goroutine so bench() workers never block on anything but the channel send.
+func recordOutput(conf *Configuration, writer Writer, output *Output) {
+	atomic.AddInt64(&conf.result.requests, 1)
+	atomic.AddInt64(&conf.result.bytesIn, output.bytesIn)
+	if output.bytesOut > 0 {
+		atomic.AddInt64(&conf.result.bytesOut, output.bytesOut)
+	}
+
+	switch output.category {
+	case "net":
+		atomic.AddInt64(&conf.result.networkFailed, 1)
+	case "bad":
+		atomic.AddInt64(&conf.result.badFailed, 1)
+		latencyMs := output.received.Sub(output.intendedStart).Seconds() * 1000
+		conf.latencies.add(latencyMs)
+		conf.histogram.add(latencyMs)
+	case "succ":
+		atomic.AddInt64(&conf.result.success, 1)
+		latencyMs := output.received.Sub(output.intendedStart).Seconds() * 1000
+		conf.latencies.add(latencyMs)
+		conf.histogram.add(latencyMs)
+	}
+
+	if writer != nil {
+		if err := writer.Write(output); err != nil {
+			logMeUpFam(fmt.Sprintf("writer error: %v", err))
+		}
+	}
+}
+
+// printProgress prints a one-line status update every second until done is
+// closed, ahead of the final summary main prints once every client finishes.
+func printProgress(conf *Configuration, done <-chan struct{}) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			total := atomic.LoadInt64(&conf.result.requests)
+			elapsed := time.Since(conf.startedAt).Seconds()
+			rps := float64(total) / elapsed
+
+			errRate := 0.0
+			if total > 0 {
+				failed := atomic.LoadInt64(&conf.result.networkFailed) + atomic.LoadInt64(&conf.result.badFailed)
+				errRate = float64(failed) / float64(total) * 100
+			}
+
+			p50, _, p99, _, _ := conf.latencies.percentiles()
+			fmt.Printf("[SPOTTER]: %8.1f rps | in-flight %4d | p50 %8.2fms | p99 %8.2fms | errors %5.2f%%\n",
+				rps, atomic.LoadInt64(&conf.result.inFlight), p50, p99, errRate)
+		}
+	}
+}
+
+// latencyBuckets are the upper bounds (ms) used for the /metrics histogram.
+var latencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// startMetricsServer exposes /metrics (Prometheus text format) and /livez
+// for the duration of the run, so a run can be scraped or health-checked
+// from outside instead of only reporting a summary at the very end.
+func startMetricsServer(addr string, conf *Configuration) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeMetrics(w, conf)
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeLivez(w, conf)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logMeUpFam(fmt.Sprintf("metrics server on %s stopped: %v", addr, err))
+		}
+	}()
+}
+
+func writeMetrics(w http.ResponseWriter, conf *Configuration) {
+	result := conf.result
+
+	fmt.Fprintln(w, "# HELP spotter_requests_total Total requests issued.")
+	fmt.Fprintln(w, "# TYPE spotter_requests_total counter")
+	fmt.Fprintf(w, "spotter_requests_total %d\n", atomic.LoadInt64(&result.requests))
+
+	fmt.Fprintln(w, "# HELP spotter_requests_success_total Requests that returned a 2xx.")
+	fmt.Fprintln(w, "# TYPE spotter_requests_success_total counter")
+	fmt.Fprintf(w, "spotter_requests_success_total %d\n", atomic.LoadInt64(&result.success))
+
+	fmt.Fprintln(w, "# HELP spotter_requests_network_failed_total Requests that never got a response.")
+	fmt.Fprintln(w, "# TYPE spotter_requests_network_failed_total counter")
+	fmt.Fprintf(w, "spotter_requests_network_failed_total %d\n", atomic.LoadInt64(&result.networkFailed))
+
+	fmt.Fprintln(w, "# HELP spotter_requests_bad_total Requests that returned a non-2xx status.")
+	fmt.Fprintln(w, "# TYPE spotter_requests_bad_total counter")
+	fmt.Fprintf(w, "spotter_requests_bad_total %d\n", atomic.LoadInt64(&result.badFailed))
+
+	fmt.Fprintln(w, "# HELP spotter_bytes_in_total Response bytes read.")
+	fmt.Fprintln(w, "# TYPE spotter_bytes_in_total counter")
+	fmt.Fprintf(w, "spotter_bytes_in_total %d\n", atomic.LoadInt64(&result.bytesIn))
+
+	fmt.Fprintln(w, "# HELP spotter_bytes_out_total Request bytes sent.")
+	fmt.Fprintln(w, "# TYPE spotter_bytes_out_total counter")
+	fmt.Fprintf(w, "spotter_bytes_out_total %d\n", atomic.LoadInt64(&result.bytesOut))
+
+	fmt.Fprintln(w, "# HELP spotter_in_flight_requests Requests currently awaiting a response.")
+	fmt.Fprintln(w, "# TYPE spotter_in_flight_requests gauge")
+	fmt.Fprintf(w, "spotter_in_flight_requests %d\n", atomic.LoadInt64(&result.inFlight))
+
+	writeLatencyHistogram(w, conf.histogram)
+}
+
+// writeLatencyHistogram renders the whole-run latencyHistogram as a
+// Prometheus histogram. Because the underlying counters only ever go up,
+// _count/_bucket/_sum grow across scrapes like spotter_requests_total
+// instead of sliding with a recency-biased sample window (network
+// failures have no latency and are not counted here), so
+// rate()/histogram_quantile() over this series won't see it go backwards.
+func writeLatencyHistogram(w http.ResponseWriter, histogram *latencyHistogram) {
+	buckets := histogram.buckets
+	cumulative, sum, count := histogram.snapshot()
+
+	fmt.Fprintln(w, "# HELP spotter_request_latency_ms Request latency from intendedStart to received, in milliseconds.")
+	fmt.Fprintln(w, "# TYPE spotter_request_latency_ms histogram")
+
+	for i, bucket := range buckets {
+		fmt.Fprintf(w, "spotter_request_latency_ms_bucket{le=\"%g\"} %d\n", bucket, cumulative[i])
+	}
+	fmt.Fprintf(w, "spotter_request_latency_ms_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "spotter_request_latency_ms_sum %f\n", sum)
+	fmt.Fprintf(w, "spotter_request_latency_ms_count %d\n", count)
+}
+
+func writeLivez(w http.ResponseWriter, conf *Configuration) {
+	result := conf.result
+	total := atomic.LoadInt64(&result.requests)
+	elapsed := time.Since(conf.startedAt).Seconds()
+	p50, p90, p99, p999, max := conf.histogram.percentiles()
+
+	fmt.Fprintf(w, "requests=%d success=%d net_failed=%d bad_failed=%d rps=%.2f in_flight=%d p50_ms=%.2f p90_ms=%.2f p99_ms=%.2f p99.9_ms=%.2f max_ms=%.2f\n",
+		total, atomic.LoadInt64(&result.success), atomic.LoadInt64(&result.networkFailed), atomic.LoadInt64(&result.badFailed),
+		float64(total)/elapsed, atomic.LoadInt64(&result.inFlight), p50, p90, p99, p999, max)
+}
+
+// percentile returns the p-th percentile (0-100) of an already-sorted slice.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p / 100 * float64(len(sorted)-1))
+	return sorted[idx]
 }
 
 func flexItOut(hunkLevel int) {
@@ -266,39 +806,405 @@ func flexItOut(hunkLevel int) {
 	f.Write(b)
 }
 
-func bench(conf *Configuration, barrier *sync.WaitGroup, id int) {
+func bench(conf *Configuration, pool []*http.Client, schedule <-chan time.Time, barrier *sync.WaitGroup, id int) {
 	defer barrier.Done()
+
+	if conf.scenario != nil {
+		benchScenario(conf, pool, schedule, id)
+		return
+	}
+
 	for i := int64(1); i <= conf.requests; i++ {
 		logMeUpFam(fmt.Sprintf("Client %d making request %d", id, i))
-		conf.resultBuffer <- crunchRequest(conf)
+		client := pool[int(i-1)%len(pool)]
+
+		intendedStart := time.Now()
+		if schedule != nil {
+			intendedStart = <-schedule
+		}
+
+		atomic.AddInt64(&conf.result.inFlight, 1)
+		output := crunchRequest(client, conf.request, intendedStart, nil, nil, conf.auth)
+		atomic.AddInt64(&conf.result.inFlight, -1)
+
+		conf.resultBuffer <- output
 	}
 }
 
+// benchScenario drives a Scenario for one worker. Each worker keeps its own
+// variable store so values extracted in one step (e.g. an auth token) carry
+// forward into later steps without racing other workers.
+func benchScenario(conf *Configuration, pool []*http.Client, schedule <-chan time.Time, id int) {
+	vars := make(map[string]string)
+	sequential := !conf.scenario.usesWeights()
+
+	for i := int64(1); i <= conf.requests; i++ {
+		logMeUpFam(fmt.Sprintf("Client %d running scenario iteration %d", id, i))
+		client := pool[int(i-1)%len(pool)]
+
+		steps := conf.scenario.Steps
+		if !sequential {
+			steps = []Step{*conf.scenario.pickWeighted()}
+		}
+
+		for _, step := range steps {
+			intendedStart := time.Now()
+			if schedule != nil {
+				intendedStart = <-schedule
+			}
+
+			req, err := createHttpRequestFromStep(&step, vars)
+			if err != nil {
+				logMeUpFam(fmt.Sprintf("Client %d: building request from step: %v", id, err))
+				conf.resultBuffer <- &Output{category: "bad", respBody: err.Error(), intendedStart: intendedStart, sent: intendedStart, received: time.Now()}
+				continue
+			}
+
+			atomic.AddInt64(&conf.result.inFlight, 1)
+			output := crunchRequest(client, req, intendedStart, step.Extract, vars, conf.auth)
+			atomic.AddInt64(&conf.result.inFlight, -1)
+
+			conf.resultBuffer <- output
+		}
+	}
+}
+
+// scheduleArrivals drives open-loop load generation: it paces out each
+// request's intendedStart in real time and hands them out over a small
+// channel, so a saturated server queues requests instead of the benchmark
+// silently slowing down to match it (coordinated omission). Workers block
+// on this channel instead of firing the next request as soon as the last
+// returns. The channel is deliberately tiny rather than sized to total —
+// same reasoning as the bounded resultBufferSize Output channel.
+func scheduleArrivals(rate float64, poisson bool, total int64) <-chan time.Time {
+	schedule := make(chan time.Time, 1)
+	interval := time.Duration(float64(time.Second) / rate)
+
+	go func() {
+		defer close(schedule)
+		next := time.Now()
+		for i := int64(0); i < total; i++ {
+			if poisson {
+				next = next.Add(time.Duration(rand.ExpFloat64() * float64(interval)))
+			} else {
+				next = next.Add(interval)
+			}
+			time.Sleep(time.Until(next))
+			schedule <- next
+		}
+	}()
+
+	return schedule
+}
+
+// newClientPool builds `size` independent *http.Client, each with its own
+// connection (or QUIC session) pool, so a worker driving h2/h3 traffic can
+// measure multiplexing behavior instead of funneling everything through one
+// shared transport.
+func newClientPool(size int, proto string, tlsConfig *tls.Config, dialer *net.Dialer) []*http.Client {
+	pool := make([]*http.Client, size)
+	checkRedirect := func(req *http.Request, reqList []*http.Request) error {
+		switch {
+		case redirects == -1:
+			return http.ErrUseLastResponse
+		case len(reqList) > redirects:
+			return fmt.Errorf("[SPOTTER]: Followed %d redirects. Stopping...", redirects)
+		default:
+			return nil
+		}
+	}
+
+	for i := range pool {
+		pool[i] = &http.Client{
+			Transport:     newTransport(proto, tlsConfig, dialer),
+			CheckRedirect: checkRedirect,
+		}
+	}
+
+	return pool
+}
+
+// newTransport selects a protocol-specific http.RoundTripper so -proto can
+// swap between plain HTTP/1.1, negotiated/forced HTTP/2, prior-knowledge
+// h2c, and QUIC-based HTTP/3 without bench() caring which one it got.
+func newTransport(proto string, tlsConfig *tls.Config, dialer *net.Dialer) http.RoundTripper {
+	switch proto {
+	case "h2c":
+		return limitStreams(&http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+			MaxHeaderListSize: 0,
+		})
+	case "h2":
+		transport := &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: requestTimeout,
+			ForceAttemptHTTP2:     true,
+		}
+		if err := http2.ConfigureTransport(transport); err != nil {
+			logMeUpFam(fmt.Sprintf("Could not force HTTP/2, falling back to negotiated: %v", err))
+		}
+		return limitStreams(transport)
+	case "h3":
+		// MaxIncomingStreams bounds streams the *server* may open toward us,
+		// not our own outbound concurrency, so it can't express -max-streams
+		// on its own. limitStreams below is what actually throttles us.
+		return limitStreams(&http3.RoundTripper{
+			TLSClientConfig: tlsConfig,
+			QuicConfig:      &quic.Config{},
+		})
+	default: // h1
+		return &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			ResponseHeaderTimeout: requestTimeout,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			MaxIdleConnsPerHost:   10000, // this should be a variable :thinking_face:
+		}
+	}
+}
+
+// limitStreams wraps rt so no more than maxStreams requests are in flight
+// on it at once. Neither http2.Transport nor http3.RoundTripper expose a
+// client-side knob for "concurrent streams this client may open" (the h2
+// SETTINGS value and the h3 QUIC stream limit are both advertised by the
+// peer, not set by us), so -max-streams is enforced here instead, one
+// semaphore per connection pool entry.
+func limitStreams(rt http.RoundTripper) http.RoundTripper {
+	if maxStreams <= 0 {
+		return rt
+	}
+	return &streamLimitedTransport{
+		rt:  rt,
+		sem: make(chan struct{}, maxStreams),
+	}
+}
+
+type streamLimitedTransport struct {
+	rt  http.RoundTripper
+	sem chan struct{}
+}
+
+func (s *streamLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.sem <- struct{}{}
+	defer func() { <-s.sem }()
+	return s.rt.RoundTrip(req)
+}
+
 func logMeUpFam(logMsg string) {
 	if devLogger {
 		log.Println(logMsg)
 	}
 }
 
-func crunchRequest(conf *Configuration) *Output {
-	resp, err := conf.client.Do(conf.request)
-	if err != nil {
-		return &Output{"net", err.Error()}
+// bufferPool recycles the *bytes.Buffer used to capture a response body, so
+// high-RPS runs that do capture bodies aren't allocating one per request.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// crunchRequest fires req and turns the result into an Output. When extract
+// rules are supplied (scenario steps), matched values are written into vars
+// for later steps to pick up via {{.name}}. When auth is supplied and the
+// first attempt comes back 401, it refreshes credentials and re-drives the
+// request once, transparently to the caller.
+func crunchRequest(client *http.Client, req *http.Request, intendedStart time.Time, extract []ExtractRule, vars map[string]string, auth AuthProvider) *Output {
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+	}
+	// Clone rather than WithContext: on the single-URL path every worker
+	// shares conf.request, and a shallow copy would share its Header map,
+	// so auth.Apply's SetBasicAuth/Header.Set below would race across
+	// goroutines. Clone deep-copies Header, giving each call its own, but
+	// it still carries over the original Body by reference - rebuild it
+	// from GetBody so concurrent/repeated sends each replay the full
+	// payload instead of racing to drain one shared reader.
+	req = req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return &Output{category: "bad", respBody: err.Error(), intendedStart: intendedStart, sent: intendedStart, received: time.Now()}
+		}
+		req.Body = body
 	}
 
-	defer resp.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if auth != nil {
+		if err := auth.Apply(req); err != nil {
+			return &Output{category: "bad", respBody: err.Error(), intendedStart: intendedStart, sent: intendedStart, received: time.Now()}
+		}
+	}
+
+	sent := time.Now()
+	resp, err := client.Do(req)
 	if err != nil {
-		logMeUpFam("Error reading body of the response!")
-		return &Output{"bad", err.Error()}
+		return &Output{category: "net", respBody: err.Error(), intendedStart: intendedStart, sent: sent, received: time.Now()}
 	}
 
+	if auth != nil && resp.StatusCode == http.StatusUnauthorized {
+		resp = retryWithRefreshedAuth(client, req, resp, auth)
+	}
+
+	defer resp.Body.Close()
 	statusCode := resp.StatusCode
 
+	// Extract rules need the bytes regardless of -capture; otherwise only
+	// "body" (always) and "body-on-error" (on a non-2xx) allocate a buffer.
+	// Everything else drains the body via io.Copy to io.Discard so
+	// keep-alive is preserved without reading the response into memory.
+	wantsBody := captureMode == CaptureBody || len(extract) > 0 ||
+		(captureMode == CaptureBodyOnError && statusCode >= 300)
+
+	var respBody string
+	var bytesIn int64
+
+	if wantsBody {
+		buf := bufferPool.Get().(*bytes.Buffer)
+		buf.Reset()
+
+		n, readErr := io.Copy(buf, resp.Body)
+		bytesIn = n
+		if readErr != nil {
+			logMeUpFam("Error reading body of the response!")
+			bufferPool.Put(buf)
+			return &Output{category: "bad", respBody: readErr.Error(), intendedStart: intendedStart, sent: sent, received: time.Now(), reused: reused}
+		}
+
+		if len(extract) > 0 {
+			applyExtractRules(extract, buf.Bytes(), vars)
+		}
+		if captureMode == CaptureBody || (captureMode == CaptureBodyOnError && statusCode >= 300) {
+			respBody = buf.String()
+		}
+		bufferPool.Put(buf)
+	} else {
+		n, _ := io.Copy(io.Discard, resp.Body)
+		bytesIn = n
+		if captureMode == CaptureHeaders {
+			respBody = formatHeaders(resp)
+		}
+	}
+
+	out := &Output{
+		respBody:      respBody,
+		intendedStart: intendedStart,
+		sent:          sent,
+		received:      time.Now(),
+		bytesIn:       bytesIn,
+		bytesOut:      req.ContentLength,
+		reused:        reused,
+	}
+
 	if statusCode >= 200 && statusCode < 300 {
-		return &Output{"succ", string(bodyBytes)}
+		out.category = "succ"
 	} else {
-		return &Output{"bad", string(bodyBytes)}
+		out.category = "bad"
+	}
+	return out
+}
+
+// retryWithRefreshedAuth handles a 401 by refreshing credentials and
+// re-driving the request once with a fresh body. If the refresh fails, or
+// the request can't be replayed (no GetBody, e.g. a streaming reader), the
+// original 401 response is returned unchanged.
+func retryWithRefreshedAuth(client *http.Client, req *http.Request, resp *http.Response, auth AuthProvider) *http.Response {
+	if req.GetBody == nil {
+		return resp
+	}
+	if err := auth.Refresh(); err != nil {
+		logMeUpFam("Auth refresh failed: " + err.Error())
+		return resp
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return resp
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	if err := auth.Apply(retry); err != nil {
+		return resp
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	retryResp, err := client.Do(retry)
+	if err != nil {
+		return resp
+	}
+	return retryResp
+}
+
+// formatHeaders renders a response's status line and headers for
+// -capture=headers, without reading the body into memory.
+func formatHeaders(resp *http.Response) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n", resp.Status)
+	for key, values := range resp.Header {
+		fmt.Fprintf(&buf, "%s: %s\n", key, strings.Join(values, ", "))
+	}
+	return buf.String()
+}
+
+// applyExtractRules pulls values out of a response body via regex capture
+// group 1 or a dotted JSONPath, storing hits into the worker's variable
+// store under rule.Name.
+func applyExtractRules(rules []ExtractRule, body []byte, vars map[string]string) {
+	for _, rule := range rules {
+		var value string
+		switch {
+		case rule.Regex != "":
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				logMeUpFam(fmt.Sprintf("extract %s: bad regex: %v", rule.Name, err))
+				continue
+			}
+			match := re.FindSubmatch(body)
+			if len(match) < 2 {
+				continue
+			}
+			value = string(match[1])
+		case rule.JSONPath != "":
+			var parsed interface{}
+			if err := json.Unmarshal(body, &parsed); err != nil {
+				logMeUpFam(fmt.Sprintf("extract %s: body isn't JSON: %v", rule.Name, err))
+				continue
+			}
+			value = jsonPathLookup(parsed, rule.JSONPath)
+		}
+		if value != "" {
+			vars[rule.Name] = value
+		}
+	}
+}
+
+// jsonPathLookup resolves a dotted path ("data.token") against a
+// json.Unmarshal'd interface{} tree.
+func jsonPathLookup(node interface{}, path string) string {
+	current := node
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current = m[key]
+	}
+
+	switch v := current.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
 	}
 }
 
@@ -320,28 +1226,207 @@ func createHttpBody(body string) io.Reader {
 	return strings.NewReader(body)
 }
 
-func writeOutputFile(location string, body []byte) error {
-	_, err := os.Stat(location)
-	if err == nil {
+// Writer streams Outputs to a sink as a run progresses, rather than
+// accumulating everything in memory until the end. Close flushes and
+// releases the underlying sink; it's called both on a normal finish and
+// from the interrupt handler so a Ctrl-C run still leaves a usable partial
+// trace.
+type Writer interface {
+	Write(output *Output) error
+	Close() error
+}
+
+// syncWriter serializes access to an underlying Writer. The aggregator
+// goroutine calls Write for the life of the run, but main's interrupt
+// handler can call Close from a signal at any time; without this, the two
+// race on the same bufio/csv state and can truncate the final record.
+type syncWriter struct {
+	mu sync.Mutex
+	w  Writer
+}
+
+func (sw *syncWriter) Write(output *Output) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(output)
+}
+
+func (sw *syncWriter) Close() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Close()
+}
+
+// newWriter opens location (or stdout, for "-") and wraps it with the Writer
+// for the requested format. For a real file that already exists, it prompts
+// before truncating it, same as the original -output behavior.
+func newWriter(format, location string) (Writer, error) {
+	sink, err := openSink(location)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case OutputFormatNDJSON:
+		return &ndjsonWriter{w: bufio.NewWriter(sink), c: sink}, nil
+	case OutputFormatCSV:
+		return newCSVWriter(sink), nil
+	default:
+		return &jsonWriter{w: sink}, nil
+	}
+}
+
+func openSink(location string) (io.WriteCloser, error) {
+	if location == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	if _, err := os.Stat(location); err == nil {
 		fmt.Printf("\n[SPOTTER]: File %s Exists!\n", location)
 		scanner := bufio.NewScanner(os.Stdin)
-		var text string
 		for {
 			fmt.Print("[SPOTTER]: Overwrite file? (y/n): ")
 			scanner.Scan()
-			text = scanner.Text()
+			text := scanner.Text()
 			if strings.EqualFold(text, "n") {
 				fmt.Println("[SPOTTER]: Exiting since you are being difficult...")
 				os.Exit(1)
 			} else if strings.EqualFold(text, "y") {
-				err := ioutil.WriteFile(location, body, 0644)
-				return err
+				break
 			}
 		}
-	} else {
-		err := ioutil.WriteFile(location, body, 0644)
+	}
+
+	return os.Create(location)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// jsonWriter reproduces the original behavior: a single ResultFile
+// marshalled and written on Close.
+type jsonWriter struct {
+	w    io.WriteCloser
+	file ResultFile
+}
+
+func (jw *jsonWriter) Write(output *Output) error {
+	switch output.category {
+	case "net":
+		jw.file.Net = append(jw.file.Net, output.respBody)
+	case "bad":
+		jw.file.Bad = append(jw.file.Bad, output.respBody)
+	case "succ":
+		jw.file.Succ = append(jw.file.Succ, output.respBody)
+	}
+	return nil
+}
+
+func (jw *jsonWriter) Close() error {
+	data, err := json.Marshal(&jw.file)
+	if err != nil {
+		return err
+	}
+	if _, err := jw.w.Write(data); err != nil {
 		return err
 	}
+	return jw.w.Close()
+}
+
+// ndjsonOutput is one line of an ndjsonWriter's stream.
+type ndjsonOutput struct {
+	Timestamp time.Time `json:"timestamp"`
+	Category  string    `json:"category"`
+	LatencyMs float64   `json:"latencyMs"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Reused    bool      `json:"reused"`
+	Body      string    `json:"body,omitempty"`
+}
+
+// ndjsonWriter writes one Output per line, flushed as results arrive, so an
+// interrupted run still leaves a readable partial trace.
+type ndjsonWriter struct {
+	w *bufio.Writer
+	c io.Closer
+}
+
+func (nw *ndjsonWriter) Write(output *Output) error {
+	data, err := json.Marshal(ndjsonOutput{
+		Timestamp: output.received,
+		Category:  output.category,
+		LatencyMs: output.received.Sub(output.intendedStart).Seconds() * 1000,
+		BytesIn:   output.bytesIn,
+		BytesOut:  output.bytesOut,
+		Reused:    output.reused,
+		Body:      output.respBody,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := nw.w.Write(data); err != nil {
+		return err
+	}
+	if err := nw.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	return nw.w.Flush()
+}
+
+func (nw *ndjsonWriter) Close() error {
+	if err := nw.w.Flush(); err != nil {
+		return err
+	}
+	return nw.c.Close()
+}
+
+// csvWriter writes one row per Output with columns for timestamp, status,
+// latency, bytes, and error.
+type csvWriter struct {
+	w *csv.Writer
+	c io.Closer
+}
+
+func newCSVWriter(sink io.WriteCloser) *csvWriter {
+	w := csv.NewWriter(sink)
+	w.Write([]string{"timestamp", "status", "latency_ms", "bytes_in", "bytes_out", "error"})
+	w.Flush()
+	return &csvWriter{w: w, c: sink}
+}
+
+func (cw *csvWriter) Write(output *Output) error {
+	errField := ""
+	if output.category != "succ" {
+		errField = output.respBody
+	}
+
+	latencyMs := output.received.Sub(output.intendedStart).Seconds() * 1000
+	record := []string{
+		output.received.Format(time.RFC3339Nano),
+		output.category,
+		strconv.FormatFloat(latencyMs, 'f', 3, 64),
+		strconv.FormatInt(output.bytesIn, 10),
+		strconv.FormatInt(output.bytesOut, 10),
+		errField,
+	}
+
+	if err := cw.w.Write(record); err != nil {
+		return err
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	if err := cw.w.Error(); err != nil {
+		return err
+	}
+	return cw.c.Close()
 }
 
 func extractHeaderKV(header string) (string, string) {
@@ -366,3 +1451,319 @@ func createHttpRequest(requestMethod string, requestBody string, requestHeaders
 
 	return req
 }
+
+// createHttpRequestFromStep renders a scenario Step's URL, body, and headers
+// as templates against the worker's variable store and builds the request.
+func createHttpRequestFromStep(step *Step, vars map[string]string) (*http.Request, error) {
+	renderedURL, err := renderTemplate(step.URL, vars)
+	if err != nil {
+		return nil, fmt.Errorf("rendering url: %w", err)
+	}
+
+	bodySource := step.Body
+	if strings.HasPrefix(bodySource, "@") {
+		fileBytes, err := ioutil.ReadFile(bodySource[1:])
+		if err != nil {
+			return nil, fmt.Errorf("reading body file %s: %w", bodySource[1:], err)
+		}
+		bodySource = string(fileBytes)
+	}
+
+	renderedBody, err := renderTemplate(bodySource, vars)
+	if err != nil {
+		return nil, fmt.Errorf("rendering body: %w", err)
+	}
+
+	method := step.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	req, err := http.NewRequest(method, renderedURL, strings.NewReader(renderedBody))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	for key, value := range step.Headers {
+		renderedValue, err := renderTemplate(value, vars)
+		if err != nil {
+			return nil, fmt.Errorf("rendering header %s: %w", key, err)
+		}
+		req.Header.Add(key, renderedValue)
+	}
+
+	return req, nil
+}
+
+// renderTemplate executes text against the worker's variable store, with
+// randInt, uuid, now, and fileLine available so each virtual user can send
+// unique data.
+func renderTemplate(text string, vars map[string]string) (string, error) {
+	tmpl, err := template.New("step").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+var templateFuncs = template.FuncMap{
+	"randInt": func(min, max int) int { return min + rand.Intn(max-min+1) },
+	"uuid":    newUUID,
+	"now":     func() string { return time.Now().Format(time.RFC3339) },
+	"fileLine": func(name string) string {
+		line, err := fileLine(name)
+		if err != nil {
+			logMeUpFam(fmt.Sprintf("fileLine %s: %v", name, err))
+			return ""
+		}
+		return line
+	},
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = cryptorand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// fileLineSource round-robins through the lines of a file shared across all
+// workers, for "fileLine users.csv"-style per-user data.
+type fileLineSource struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+var (
+	fileLineCacheMu sync.Mutex
+	fileLineCache   = make(map[string]*fileLineSource)
+)
+
+func fileLine(name string) (string, error) {
+	fileLineCacheMu.Lock()
+	source, ok := fileLineCache[name]
+	if !ok {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			fileLineCacheMu.Unlock()
+			return "", err
+		}
+		source = &fileLineSource{lines: strings.Split(strings.TrimRight(string(data), "\n"), "\n")}
+		fileLineCache[name] = source
+	}
+	fileLineCacheMu.Unlock()
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if len(source.lines) == 0 {
+		return "", fmt.Errorf("%s has no lines", name)
+	}
+	line := source.lines[source.next%len(source.lines)]
+	source.next++
+	return line, nil
+}
+
+// AuthProvider attaches credentials to outgoing requests and knows how to
+// get a new set of credentials when the target rejects the old ones.
+type AuthProvider interface {
+	// Apply sets whatever headers are needed to authenticate req.
+	Apply(req *http.Request) error
+	// Refresh fetches new credentials. Providers that have nothing to
+	// refresh (basic, bearer) just return nil.
+	Refresh() error
+}
+
+// basicAuth sends a static username/password via HTTP Basic auth.
+type basicAuth struct {
+	user, pass string
+}
+
+func (b *basicAuth) Apply(req *http.Request) error {
+	req.SetBasicAuth(b.user, b.pass)
+	return nil
+}
+
+func (b *basicAuth) Refresh() error { return nil }
+
+// bearerAuth sends a static token in the Authorization header.
+type bearerAuth struct {
+	token string
+}
+
+func (b *bearerAuth) Apply(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return nil
+}
+
+func (b *bearerAuth) Refresh() error { return nil }
+
+// oauth2Config is the on-disk shape of an -auth oauth2:cfg.json file.
+type oauth2Config struct {
+	TokenURL     string `json:"token_url"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Scope        string `json:"scope"`
+}
+
+// oauth2Auth fetches and caches a bearer token via the OAuth2 client
+// credentials grant, refreshing it whenever the target returns a 401.
+type oauth2Auth struct {
+	cfg oauth2Config
+
+	mu    sync.Mutex
+	token string
+}
+
+func (o *oauth2Auth) Apply(req *http.Request) error {
+	o.mu.Lock()
+	token := o.token
+	o.mu.Unlock()
+
+	if token == "" {
+		if err := o.Refresh(); err != nil {
+			return err
+		}
+		o.mu.Lock()
+		token = o.token
+		o.mu.Unlock()
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (o *oauth2Auth) Refresh() error {
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {o.cfg.ClientID},
+		"client_secret": {o.cfg.ClientSecret},
+	}
+	if o.cfg.Scope != "" {
+		form.Set("scope", o.cfg.Scope)
+	}
+
+	resp, err := http.PostForm(o.cfg.TokenURL, form)
+	if err != nil {
+		return fmt.Errorf("oauth2 token refresh: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oauth2 token refresh: %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("oauth2 token refresh: %w", err)
+	}
+	if body.AccessToken == "" {
+		return fmt.Errorf("oauth2 token refresh: response had no access_token")
+	}
+
+	o.mu.Lock()
+	o.token = body.AccessToken
+	o.mu.Unlock()
+	return nil
+}
+
+// parseAuthFlag turns the -auth flag value into an AuthProvider. Supported
+// forms:
+//
+//	basic:user:pass
+//	bearer:token        (or bearer:@token.txt to read the token from a file)
+//	oauth2:cfg.json
+func parseAuthFlag(value string) (AuthProvider, error) {
+	scheme, rest, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, fmt.Errorf("expected scheme:value, got %q", value)
+	}
+
+	switch scheme {
+	case "basic":
+		user, pass, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil, fmt.Errorf("basic auth needs user:pass, got %q", rest)
+		}
+		return &basicAuth{user: user, pass: pass}, nil
+
+	case "bearer":
+		token, err := resolveMaybeFile(rest)
+		if err != nil {
+			return nil, fmt.Errorf("bearer auth: %w", err)
+		}
+		return &bearerAuth{token: token}, nil
+
+	case "oauth2":
+		data, err := ioutil.ReadFile(rest)
+		if err != nil {
+			return nil, fmt.Errorf("oauth2 config: %w", err)
+		}
+		var cfg oauth2Config
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("oauth2 config: %w", err)
+		}
+		if cfg.TokenURL == "" {
+			return nil, fmt.Errorf("oauth2 config: token_url is required")
+		}
+		return &oauth2Auth{cfg: cfg}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q (want basic, bearer, or oauth2)", scheme)
+	}
+}
+
+// resolveMaybeFile returns value verbatim, unless it starts with "@", in
+// which case the rest is treated as a file path and its trimmed contents
+// are returned instead.
+func resolveMaybeFile(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// newTLSConfig builds the TLS config used for every client connection from
+// the -insecure, -client-cert/-client-key, and -ca-cert flags.
+func newTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: insecureSkip,
+	}
+
+	if clientCertFile != "" || clientKeyFile != "" {
+		if clientCertFile == "" || clientKeyFile == "" {
+			return nil, fmt.Errorf("-client-cert and -client-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client cert/key: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caCertFile != "" {
+		pem, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading -ca-cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in -ca-cert %s", caCertFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}